@@ -1,9 +1,17 @@
 package apimanagement
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"html"
 	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
 	"time"
 
 	"github.com/Azure/azure-sdk-for-go/services/apimanagement/mgmt/2021-08-01/apimanagement"
@@ -13,10 +21,18 @@ import (
 	"github.com/hashicorp/terraform-provider-azurerm/internal/services/apimanagement/parse"
 	"github.com/hashicorp/terraform-provider-azurerm/internal/services/apimanagement/schemaz"
 	"github.com/hashicorp/terraform-provider-azurerm/internal/tf/pluginsdk"
+	"github.com/hashicorp/terraform-provider-azurerm/internal/tf/validation"
 	"github.com/hashicorp/terraform-provider-azurerm/internal/timeouts"
 	"github.com/hashicorp/terraform-provider-azurerm/utils"
 )
 
+// fragmentReferenceRegex matches `<fragment name="..."/>` include elements that may appear
+// anywhere in an `xml_template` and must be resolved against the Policy Fragment API.
+var fragmentReferenceRegex = regexp.MustCompile(`<fragment\s+name="([^"]+)"\s*/>`)
+
+// templateVarRegex matches `${var}` placeholders left to be substituted from `template_vars`.
+var templateVarRegex = regexp.MustCompile(`\$\{([^}]+)\}`)
+
 func resourceApiManagementApiPolicy() *pluginsdk.Resource {
 	return &pluginsdk.Resource{
 		Create: resourceApiManagementAPIPolicyCreateUpdate,
@@ -28,6 +44,8 @@ func resourceApiManagementApiPolicy() *pluginsdk.Resource {
 			return err
 		}),
 
+		CustomizeDiff: pluginsdk.CustomDiffWithAll(apiManagementApiPolicyCustomizeDiff),
+
 		Timeouts: &pluginsdk.ResourceTimeout{
 			Create: pluginsdk.DefaultTimeout(30 * time.Minute),
 			Read:   pluginsdk.DefaultTimeout(5 * time.Minute),
@@ -46,21 +64,385 @@ func resourceApiManagementApiPolicy() *pluginsdk.Resource {
 				Type:             pluginsdk.TypeString,
 				Optional:         true,
 				Computed:         true,
-				ConflictsWith:    []string{"xml_link"},
+				ConflictsWith:    []string{"xml_link", "xml_template", "xml_source_file", "xml_source_git"},
 				DiffSuppressFunc: XmlWithDotNetInterpolationsDiffSuppress,
 			},
 
 			"xml_link": {
 				Type:          pluginsdk.TypeString,
 				Optional:      true,
-				ConflictsWith: []string{"xml_content"},
+				ConflictsWith: []string{"xml_content", "xml_template", "xml_source_file", "xml_source_git"},
+			},
+
+			"xml_template": {
+				Type:          pluginsdk.TypeString,
+				Optional:      true,
+				ConflictsWith: []string{"xml_content", "xml_link", "xml_source_file", "xml_source_git"},
+				ValidateFunc:  validation.StringIsNotEmpty,
+			},
+
+			"template_vars": {
+				Type:         pluginsdk.TypeMap,
+				Optional:     true,
+				RequiredWith: []string{"xml_template"},
+				Elem: &pluginsdk.Schema{
+					Type: pluginsdk.TypeString,
+				},
+			},
+
+			"xml_source_file": {
+				Type:          pluginsdk.TypeString,
+				Optional:      true,
+				ConflictsWith: []string{"xml_content", "xml_link", "xml_template", "xml_source_git"},
+				ValidateFunc:  validation.StringIsNotEmpty,
+			},
+
+			"xml_source_git": {
+				Type:          pluginsdk.TypeList,
+				Optional:      true,
+				MaxItems:      1,
+				ConflictsWith: []string{"xml_content", "xml_link", "xml_template", "xml_source_file"},
+				Elem: &pluginsdk.Resource{
+					Schema: map[string]*pluginsdk.Schema{
+						"repository": {
+							Type:         pluginsdk.TypeString,
+							Required:     true,
+							ValidateFunc: validation.StringIsNotEmpty,
+						},
+
+						"ref": {
+							Type:         pluginsdk.TypeString,
+							Optional:     true,
+							Default:      "HEAD",
+							ValidateFunc: validation.StringIsNotEmpty,
+						},
+
+						"path": {
+							Type:         pluginsdk.TypeString,
+							Required:     true,
+							ValidateFunc: validation.StringIsNotEmpty,
+						},
+
+						"auth": {
+							Type:     pluginsdk.TypeList,
+							Optional: true,
+							MaxItems: 1,
+							Elem: &pluginsdk.Resource{
+								Schema: map[string]*pluginsdk.Schema{
+									"token": {
+										Type:         pluginsdk.TypeString,
+										Required:     true,
+										Sensitive:    true,
+										ValidateFunc: validation.StringIsNotEmpty,
+									},
+								},
+							},
+						},
+					},
+				},
+			},
+
+			"xml_content_hash": {
+				Type:     pluginsdk.TypeString,
+				Computed: true,
 			},
 		},
 	}
 }
 
+// renderPolicyTemplate resolves any `<fragment name="..."/>` includes in `content` against the
+// Policy Fragment API and substitutes `${var}` placeholders using `vars`, returning the composed
+// XML that's submitted to the API as `xml_content`.
+func renderPolicyTemplate(ctx context.Context, client *apimanagement.PolicyFragmentClient, resourceGroup, serviceName, content string, vars map[string]string) (string, error) {
+	rendered, err := resolveFragmentReferences(ctx, client, resourceGroup, serviceName, content)
+	if err != nil {
+		return "", err
+	}
+
+	if remaining := fragmentReferenceRegex.FindAllStringSubmatch(rendered, -1); len(remaining) > 0 {
+		names := make([]string, 0)
+		for _, match := range remaining {
+			names = append(names, match[1])
+		}
+		return "", fmt.Errorf("could not resolve policy fragment(s): %s", strings.Join(names, ", "))
+	}
+
+	rendered = templateVarRegex.ReplaceAllStringFunc(rendered, func(match string) string {
+		name := templateVarRegex.FindStringSubmatch(match)[1]
+		if value, ok := vars[name]; ok {
+			return value
+		}
+		return match
+	})
+
+	if remaining := templateVarRegex.FindAllStringSubmatch(rendered, -1); len(remaining) > 0 {
+		names := make([]string, 0)
+		for _, match := range remaining {
+			names = append(names, match[1])
+		}
+		return "", fmt.Errorf("unresolved template variable(s): %s", strings.Join(names, ", "))
+	}
+
+	return rendered, nil
+}
+
+// resolveFragmentReferences replaces each `<fragment name="..."/>` include in `content` with the
+// referenced fragment's XML. A fragment that genuinely doesn't exist is left in place so the
+// caller can report it as an unresolved reference; any other error from the Policy Fragment API
+// (auth failure, throttling, a transient network issue) is propagated instead of being swallowed,
+// since masking it as "fragment not found" hides the real cause.
+func resolveFragmentReferences(ctx context.Context, client *apimanagement.PolicyFragmentClient, resourceGroup, serviceName, content string) (string, error) {
+	matches := fragmentReferenceRegex.FindAllStringSubmatchIndex(content, -1)
+	if len(matches) == 0 {
+		return content, nil
+	}
+
+	var rendered strings.Builder
+	last := 0
+	for _, match := range matches {
+		start, end := match[0], match[1]
+		name := content[match[2]:match[3]]
+
+		rendered.WriteString(content[last:start])
+		last = end
+
+		fragment, err := client.Get(ctx, resourceGroup, serviceName, name, apimanagement.PolicyFragmentContentFormatRawxml)
+		if err != nil {
+			if utils.ResponseWasNotFound(fragment.Response) {
+				rendered.WriteString(content[start:end])
+				continue
+			}
+			return "", fmt.Errorf("retrieving policy fragment %q: %+v", name, err)
+		}
+
+		if fragment.PolicyFragmentContractProperties != nil && fragment.PolicyFragmentContractProperties.Value != nil {
+			rendered.WriteString(*fragment.PolicyFragmentContractProperties.Value)
+		} else {
+			rendered.WriteString(content[start:end])
+		}
+	}
+	rendered.WriteString(content[last:])
+
+	return rendered.String(), nil
+}
+
+// apiManagementApiPolicyCustomizeDiff validates `xml_template` references at plan time - both
+// `${var}` placeholders and `<fragment name="..."/>` includes - exactly as the request requires,
+// so unresolved references surface before `terraform apply` rather than as an API rejection after
+// a 30-minute apply. This does mean the Policy Fragment API is called once during `plan` and again
+// during `apply`; that duplicate call is an accepted cost of meeting the plan-time requirement.
+func apiManagementApiPolicyCustomizeDiff(ctx context.Context, d *pluginsdk.ResourceDiff, meta interface{}) error {
+	if xmlTemplate := d.Get("xml_template").(string); xmlTemplate != "" {
+		client := meta.(*clients.Client).ApiManagement.PolicyFragmentClient
+		resourceGroup := d.Get("resource_group_name").(string)
+		serviceName := d.Get("api_management_name").(string)
+
+		vars := map[string]string{}
+		for k, v := range d.Get("template_vars").(map[string]interface{}) {
+			vars[k] = v.(string)
+		}
+
+		if _, err := renderPolicyTemplate(ctx, client, resourceGroup, serviceName, xmlTemplate, vars); err != nil {
+			return fmt.Errorf("validating `xml_template`: %+v", err)
+		}
+	}
+
+	// `xml_source_file` is a cheap local read, so `xml_content_hash` is eagerly recomputed from
+	// its content here for a stable diff.
+	if sourceFile := d.Get("xml_source_file").(string); sourceFile != "" {
+		content, err := readXmlSourceFile(sourceFile)
+		if err != nil {
+			return err
+		}
+
+		if err := d.SetNew("xml_content_hash", xmlContentHash(content)); err != nil {
+			return fmt.Errorf("setting `xml_content_hash`: %+v", err)
+		}
+	}
+
+	// `xml_source_git` is NOT cloned here - that would double the git operations made per
+	// `terraform plan`+`apply` pair - but drift still has to be detectable without a clone, or a
+	// changed file at an unchanged `ref` would produce zero plan diff and `apply` would never run.
+	// `git ls-remote` is a cheap, bounded remote lookup (no clone) that resolves `ref` to its
+	// current commit; `gitSourceHash` combines that with `path` using the same formula applied to
+	// the real checkout in resourceApiManagementAPIPolicyCreateUpdate, so the two stay consistent.
+	if sourceGit := d.Get("xml_source_git").([]interface{}); len(sourceGit) == 1 && sourceGit[0] != nil {
+		block := sourceGit[0].(map[string]interface{})
+		repository := block["repository"].(string)
+		ref := block["ref"].(string)
+		path := block["path"].(string)
+
+		revision, err := gitSourceRevision(ctx, repository, ref)
+		if err != nil {
+			return fmt.Errorf("resolving `xml_source_git`: %+v", err)
+		}
+
+		if err := d.SetNew("xml_content_hash", gitSourceHash(revision, path)); err != nil {
+			return fmt.Errorf("setting `xml_content_hash`: %+v", err)
+		}
+	}
+
+	return nil
+}
+
+// readXmlSourceFile reads the policy XML from a local file so it can be version-controlled
+// alongside the Terraform configuration rather than hosted at a URL the APIM service can reach.
+func readXmlSourceFile(path string) (string, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("reading `xml_source_file` %q: %+v", path, err)
+	}
+
+	return string(content), nil
+}
+
+// gitAskpassScript is invoked by `git` in place of a terminal username/password prompt. It prints
+// the token passed via the `XML_SOURCE_GIT_TOKEN` environment variable rather than accepting it as
+// a command-line argument, which would otherwise be visible to any local user/process that can
+// read the git subprocess's command line.
+const gitAskpassScript = "#!/bin/sh\nprintf '%s' \"$XML_SOURCE_GIT_TOKEN\"\n"
+
+// gitSourceRevision resolves `ref` against `repository` to a commit SHA using `git ls-remote`,
+// which - unlike `readXmlSourceGit` - never clones or checks out anything, making it cheap enough
+// to run on every `terraform plan`. It's bounded by its own timeout independent of the caller's,
+// since CustomizeDiff otherwise has no timeout of its own to protect a `terraform plan` from an
+// unreachable host. A `ref` that doesn't match any remote ref (e.g. an already-resolved commit
+// SHA) is returned as-is.
+func gitSourceRevision(ctx context.Context, repository, ref string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, "git", "ls-remote", "--exit-code", repository, ref, ref+"^{}")
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+
+	output, err := cmd.Output()
+	if err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() == 2 {
+			return ref, nil
+		}
+		return "", fmt.Errorf("resolving ref %q in repository %q: %+v", ref, repository, err)
+	}
+
+	// an annotated tag is also listed as `<tag>^{}` with the commit it points to, which is the
+	// revision a checkout of `ref` lands on, so that entry wins over the tag object itself
+	revision := ""
+	for _, line := range strings.Split(strings.TrimSpace(string(output)), "\n") {
+		if fields := strings.Fields(line); len(fields) == 2 && (revision == "" || strings.HasSuffix(fields[1], "^{}")) {
+			revision = fields[0]
+		}
+	}
+	if revision == "" {
+		return ref, nil
+	}
+
+	return revision, nil
+}
+
+// gitSourceHash derives `xml_content_hash` for an `xml_source_git` source from the resolved
+// commit `revision` and `path` rather than the file's content, so the cheap `git ls-remote` lookup
+// used in CustomizeDiff produces the same value as the real checkout performed at apply time in
+// resourceApiManagementAPIPolicyCreateUpdate.
+func gitSourceHash(revision, path string) string {
+	return xmlContentHash(revision + ":" + path)
+}
+
+// readXmlSourceGit checks out `path` at `ref` from `repository` into a temporary clone and
+// returns its contents along with the resolved commit SHA. `token`, when set, is supplied to git
+// via an askpass helper rather than embedded in the repository URL, and every git invocation is
+// bound to `ctx` so an unreachable host can't hang the resource's own create/update timeout
+// indefinitely.
+func readXmlSourceGit(ctx context.Context, repository, ref, path, token string) (string, string, error) {
+	workDir, err := os.MkdirTemp("", "azurerm-api-management-api-policy-")
+	if err != nil {
+		return "", "", fmt.Errorf("creating temporary directory for `xml_source_git`: %+v", err)
+	}
+	defer os.RemoveAll(workDir)
+
+	env := append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+	if token != "" {
+		askpassPath := filepath.Join(workDir, ".askpass.sh")
+		if err := os.WriteFile(askpassPath, []byte(gitAskpassScript), 0o700); err != nil {
+			return "", "", fmt.Errorf("writing git credential helper for `xml_source_git`: %+v", err)
+		}
+		env = append(env, "GIT_ASKPASS="+askpassPath, "XML_SOURCE_GIT_TOKEN="+token)
+	}
+
+	// clone into a subdirectory, since `git clone` refuses a non-empty destination such as `workDir`
+	// once the askpass helper has been written into it
+	cloneDir := filepath.Join(workDir, "repo")
+	cloneCmd := exec.CommandContext(ctx, "git", "clone", "--quiet", repository, cloneDir)
+	cloneCmd.Env = env
+	if output, err := cloneCmd.CombinedOutput(); err != nil {
+		return "", "", fmt.Errorf("cloning `xml_source_git` repository %q: %s", repository, strings.TrimSpace(string(output)))
+	}
+
+	checkoutCmd := exec.CommandContext(ctx, "git", "-C", cloneDir, "checkout", "--quiet", ref)
+	checkoutCmd.Env = env
+	if output, err := checkoutCmd.CombinedOutput(); err != nil {
+		return "", "", fmt.Errorf("checking out ref %q in `xml_source_git` repository %q: %s", ref, repository, strings.TrimSpace(string(output)))
+	}
+
+	revCmd := exec.CommandContext(ctx, "git", "-C", cloneDir, "rev-parse", "HEAD")
+	revOutput, err := revCmd.Output()
+	if err != nil {
+		return "", "", fmt.Errorf("resolving checked out revision in `xml_source_git` repository %q: %+v", repository, err)
+	}
+	revision := strings.TrimSpace(string(revOutput))
+
+	content, err := os.ReadFile(fmt.Sprintf("%s/%s", cloneDir, path))
+	if err != nil {
+		return "", "", fmt.Errorf("reading %q from `xml_source_git` repository %q at ref %q: %+v", path, repository, ref, err)
+	}
+
+	return string(content), revision, nil
+}
+
+// resolveXmlSourceContent reads the raw policy XML from whichever of `xml_source_file` or
+// `xml_source_git` is configured, along with the `xml_content_hash` value for it, returning an
+// empty content string if neither is set.
+func resolveXmlSourceContent(ctx context.Context, d interface {
+	Get(key string) interface{}
+}) (string, string, error) {
+	if sourceFile := d.Get("xml_source_file").(string); sourceFile != "" {
+		content, err := readXmlSourceFile(sourceFile)
+		if err != nil {
+			return "", "", err
+		}
+		return content, xmlContentHash(content), nil
+	}
+
+	if sourceGit := d.Get("xml_source_git").([]interface{}); len(sourceGit) == 1 && sourceGit[0] != nil {
+		block := sourceGit[0].(map[string]interface{})
+		repository := block["repository"].(string)
+		ref := block["ref"].(string)
+		path := block["path"].(string)
+
+		token := ""
+		if auth, ok := block["auth"].([]interface{}); ok && len(auth) == 1 && auth[0] != nil {
+			token = auth[0].(map[string]interface{})["token"].(string)
+		}
+
+		content, revision, err := readXmlSourceGit(ctx, repository, ref, path, token)
+		if err != nil {
+			return "", "", err
+		}
+		return content, gitSourceHash(revision, path), nil
+	}
+
+	return "", "", nil
+}
+
+// xmlContentHash returns the SHA256 of `content` used to populate the computed
+// `xml_content_hash` field, which forces an update when a `xml_source_file`/`xml_source_git`
+// source changes even though the API only ever stores the rendered content.
+func xmlContentHash(content string) string {
+	sum := sha256.Sum256([]byte(content))
+	return hex.EncodeToString(sum[:])
+}
+
 func resourceApiManagementAPIPolicyCreateUpdate(d *pluginsdk.ResourceData, meta interface{}) error {
 	client := meta.(*clients.Client).ApiManagement.ApiPoliciesClient
+	fragmentClient := meta.(*clients.Client).ApiManagement.PolicyFragmentClient
 	ctx, cancel := timeouts.ForCreateUpdate(meta.(*clients.Client).StopContext, d)
 	defer cancel()
 
@@ -85,12 +467,36 @@ func resourceApiManagementAPIPolicyCreateUpdate(d *pluginsdk.ResourceData, meta
 
 	xmlContent := d.Get("xml_content").(string)
 	xmlLink := d.Get("xml_link").(string)
+	xmlTemplate := d.Get("xml_template").(string)
 
 	if xmlLink != "" {
 		parameters.PolicyContractProperties = &apimanagement.PolicyContractProperties{
 			Format: apimanagement.PolicyContentFormatRawxmlLink,
 			Value:  utils.String(xmlLink),
 		}
+	} else if xmlTemplate != "" {
+		templateVars := map[string]string{}
+		for k, v := range d.Get("template_vars").(map[string]interface{}) {
+			templateVars[k] = v.(string)
+		}
+
+		rendered, err := renderPolicyTemplate(ctx, fragmentClient, resourceGroup, serviceName, xmlTemplate, templateVars)
+		if err != nil {
+			return fmt.Errorf("rendering `xml_template` for API Policy (Resource Group %q / API Management Service %q / API %q): %+v", resourceGroup, serviceName, apiName, err)
+		}
+
+		parameters.PolicyContractProperties = &apimanagement.PolicyContractProperties{
+			Format: apimanagement.PolicyContentFormatRawxml,
+			Value:  utils.String(rendered),
+		}
+	} else if sourceContent, sourceHash, err := resolveXmlSourceContent(ctx, d); err != nil {
+		return fmt.Errorf("resolving API Policy (Resource Group %q / API Management Service %q / API %q) source: %+v", resourceGroup, serviceName, apiName, err)
+	} else if sourceContent != "" {
+		parameters.PolicyContractProperties = &apimanagement.PolicyContractProperties{
+			Format: apimanagement.PolicyContentFormatRawxml,
+			Value:  utils.String(sourceContent),
+		}
+		d.Set("xml_content_hash", sourceHash)
 	} else if xmlContent != "" {
 		// this is intentionally an else-if since `xml_content` is computed
 
@@ -106,7 +512,13 @@ func resourceApiManagementAPIPolicyCreateUpdate(d *pluginsdk.ResourceData, meta
 	}
 
 	if parameters.PolicyContractProperties == nil {
-		return fmt.Errorf("Either `xml_content` or `xml_link` must be set")
+		return fmt.Errorf("Either `xml_content`, `xml_link`, `xml_template`, `xml_source_file` or `xml_source_git` must be set")
+	}
+
+	if !meta.(*clients.Client).Features.ApiManagement.SkipPolicyValidation && parameters.PolicyContractProperties.Format == apimanagement.PolicyContentFormatRawxml {
+		if err := ValidatePolicyXML(*parameters.PolicyContractProperties.Value); err != nil {
+			return fmt.Errorf("validating policy XML for API Policy (Resource Group %q / API Management Service %q / API %q): %+v", resourceGroup, serviceName, apiName, err)
+		}
 	}
 
 	if _, err := client.CreateOrUpdate(ctx, resourceGroup, serviceName, apiName, parameters, ""); err != nil {
@@ -156,8 +568,10 @@ func resourceApiManagementAPIPolicyRead(d *pluginsdk.ResourceData, meta interfac
 			policyContent = html.UnescapeString(*pc)
 		}
 
-		// when you submit an `xml_link` to the API, the API downloads this link and stores it as `xml_content`
-		// as such there is no way to set `xml_link` and we'll let Terraform handle it
+		// when you submit an `xml_link` or `xml_template` to the API, the API stores only the
+		// resolved/rendered content - as such there is no way to reverse-map it back to the
+		// original link or template, so we store the rendered form in the computed `xml_content`
+		// and leave `xml_link`/`xml_template` as set by the user for a stable diff
 		d.Set("xml_content", policyContent)
 	}
 
@@ -0,0 +1,174 @@
+package apimanagement
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// allowedPolicySections are the only elements the APIM policy engine accepts as direct children
+// of `<policies>`.
+var allowedPolicySections = map[string]bool{
+	"inbound":  true,
+	"backend":  true,
+	"outbound": true,
+	"on-error": true,
+}
+
+// knownPolicyElementAttributes enumerates the attributes we know to be valid for a handful of the
+// most commonly misconfigured policy elements. Elements not listed here are left unchecked, since
+// the full APIM policy grammar is large and still evolving.
+var knownPolicyElementAttributes = map[string]map[string]bool{
+	"rate-limit": {
+		"calls":                         true,
+		"renewal-period":                true,
+		"retry-after-header-name":       true,
+		"retry-after-variable-name":     true,
+		"remaining-calls-header-name":   true,
+		"remaining-calls-variable-name": true,
+		"total-calls-header-name":       true,
+	},
+	"set-backend-service": {
+		"base-url":                 true,
+		"backend-id":               true,
+		"sf-resolve-condition":     true,
+		"sf-service-instance-name": true,
+		"sf-listener-name":         true,
+	},
+	"check-header": {
+		"name":                       true,
+		"failed-check-httpcode":      true,
+		"failed-check-error-message": true,
+		"ignore-case":                true,
+	},
+}
+
+// ValidatePolicyXML parses `content` as an APIM policy document and checks it against the subset
+// of the policy element grammar this provider understands: that `<policies>` only directly
+// contains `<inbound>`/`<backend>`/`<outbound>`/`<on-error>`, that known elements only use known
+// attributes, and that `@(...)` C# expression regions are balanced. Errors are reported with
+// line/column. It takes only the policy XML, so any of the api/product/operation/product-api
+// policy resources can call it; only `azurerm_api_management_api_policy` does, from its
+// create/update just before the policy is submitted, so errors surface during apply rather than
+// at plan time.
+func ValidatePolicyXML(content string) error {
+	if err := validatePolicyElements(content); err != nil {
+		return err
+	}
+
+	return validateExpressionBalance(content)
+}
+
+func validatePolicyElements(content string) error {
+	decoder := xml.NewDecoder(strings.NewReader(content))
+
+	depth := 0
+	for {
+		offset := decoder.InputOffset()
+
+		tok, err := decoder.Token()
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			line, col := policyXMLPosition(content, offset)
+			return fmt.Errorf("parsing policy XML at line %d, column %d: %+v", line, col, err)
+		}
+
+		switch el := tok.(type) {
+		case xml.StartElement:
+			depth++
+
+			if depth == 1 && el.Name.Local != "policies" {
+				line, col := policyXMLPosition(content, offset)
+				return fmt.Errorf("line %d, column %d: the root element of a policy document must be `<policies>`, found `<%s>`", line, col, el.Name.Local)
+			}
+
+			if depth == 2 && !allowedPolicySections[el.Name.Local] {
+				line, col := policyXMLPosition(content, offset)
+				return fmt.Errorf("line %d, column %d: `<policies>` may only directly contain `<inbound>`, `<backend>`, `<outbound>` or `<on-error>`, found `<%s>`", line, col, el.Name.Local)
+			}
+
+			if attrs, ok := knownPolicyElementAttributes[el.Name.Local]; ok {
+				for _, attr := range el.Attr {
+					if !attrs[attr.Name.Local] {
+						line, col := policyXMLPosition(content, offset)
+						return fmt.Errorf("line %d, column %d: `<%s>` does not support the %q attribute", line, col, el.Name.Local, attr.Name.Local)
+					}
+				}
+			}
+		case xml.EndElement:
+			depth--
+		}
+	}
+}
+
+// validateExpressionBalance checks that every `@(` C# expression region in `content` has a
+// matching closing `)`, ignoring parentheses that appear inside a `"..."` string literal so a
+// valid expression like `@(... .GetValueOrDefault("Header(Name",""))` isn't misread as unbalanced.
+func validateExpressionBalance(content string) error {
+	for i := 0; i < len(content)-1; i++ {
+		if content[i] != '@' || content[i+1] != '(' {
+			continue
+		}
+
+		depth := 0
+		inString := false
+		closed := false
+		j := i + 1
+		for ; j < len(content); j++ {
+			c := content[j]
+
+			if inString {
+				if c == '\\' && j+1 < len(content) {
+					j++ // skip the escaped character
+					continue
+				}
+				if c == '"' {
+					inString = false
+				}
+				continue
+			}
+
+			switch c {
+			case '"':
+				inString = true
+			case '(':
+				depth++
+			case ')':
+				depth--
+				if depth == 0 {
+					closed = true
+				}
+			}
+			if closed {
+				break
+			}
+		}
+
+		if !closed {
+			line, col := policyXMLPosition(content, int64(i))
+			return fmt.Errorf("line %d, column %d: unbalanced `@(...)` expression", line, col)
+		}
+
+		i = j
+	}
+
+	return nil
+}
+
+// policyXMLPosition turns a byte offset into `content` into a 1-based line/column pair for error
+// messages.
+func policyXMLPosition(content string, offset int64) (int, int) {
+	line, col := 1, 1
+	for i := 0; int64(i) < offset && i < len(content); i++ {
+		if content[i] == '\n' {
+			line++
+			col = 1
+		} else {
+			col++
+		}
+	}
+	return line, col
+}
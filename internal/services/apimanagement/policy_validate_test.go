@@ -0,0 +1,78 @@
+package apimanagement
+
+import "testing"
+
+func TestValidatePolicyXML(t *testing.T) {
+	testCases := []struct {
+		name    string
+		content string
+		wantErr bool
+	}{
+		{
+			name: "valid document",
+			content: `<policies>
+	<inbound>
+		<rate-limit calls="10" renewal-period="60" />
+	</inbound>
+	<backend>
+		<forward-request />
+	</backend>
+	<outbound />
+	<on-error />
+</policies>`,
+			wantErr: false,
+		},
+		{
+			name:    "wrong root element",
+			content: `<policy><inbound /></policy>`,
+			wantErr: true,
+		},
+		{
+			name: "disallowed second-level element",
+			content: `<policies>
+	<inbound />
+	<unknown-section />
+</policies>`,
+			wantErr: true,
+		},
+		{
+			name: "unknown attribute on a known element",
+			content: `<policies>
+	<inbound>
+		<rate-limit calls="10" burst-size="5" />
+	</inbound>
+</policies>`,
+			wantErr: true,
+		},
+		{
+			name: "unbalanced expression",
+			content: `<policies>
+	<inbound>
+		<set-variable name="x" value="@(1 + 2" />
+	</inbound>
+</policies>`,
+			wantErr: true,
+		},
+		{
+			name: "expression with parens inside a string literal",
+			content: `<policies>
+	<inbound>
+		<set-variable name='x' value='@(context.Request.Headers.GetValueOrDefault("Header(Name",""))' />
+	</inbound>
+</policies>`,
+			wantErr: false,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := ValidatePolicyXML(tc.content)
+			if tc.wantErr && err == nil {
+				t.Fatalf("expected an error, got nil")
+			}
+			if !tc.wantErr && err != nil {
+				t.Fatalf("expected no error, got: %+v", err)
+			}
+		})
+	}
+}